@@ -0,0 +1,77 @@
+package proxy
+
+// Congestion decides how many bytes a reliableConn may have in flight at
+// once, following the same state machine shape as TCP congestion control.
+type Congestion interface {
+	// Cwnd returns the current congestion window, in bytes.
+	Cwnd() int
+	// OnAck is called once per newly acknowledged packet.
+	OnAck(ackedBytes int)
+	// OnDupAck is called for each received packet whose cumulative and
+	// selective ACKs acknowledge no new packet; three in a row trigger fast
+	// recovery. A selective ACK that covers a new packet is reported through
+	// OnAck instead, which resets the count.
+	OnDupAck()
+	// OnTimeout is called when an RTO fires for an unacknowledged packet.
+	OnTimeout()
+}
+
+// NewReno implements the New Reno congestion control algorithm (RFC 6582):
+// slow start doubles cwnd every RTT until ssthresh is reached, congestion
+// avoidance then grows cwnd by roughly one MSS per RTT, a triple duplicate
+// ACK halves cwnd and enters fast recovery, and an RTO drops back to slow
+// start with ssthresh halved.
+type NewReno struct {
+	mss      float64
+	cwnd     float64
+	ssthresh float64
+	dupAcks  int
+}
+
+// NewNewReno creates a NewReno controller for a transport whose packets
+// carry up to mss bytes of payload each.
+func NewNewReno(mss int) *NewReno {
+	return &NewReno{
+		mss:      float64(mss),
+		cwnd:     float64(mss),
+		ssthresh: 64 * 1024,
+	}
+}
+
+func (c *NewReno) Cwnd() int { return int(c.cwnd) }
+
+func (c *NewReno) OnAck(ackedBytes int) {
+	c.dupAcks = 0
+
+	if c.cwnd < c.ssthresh {
+		// Slow start: cwnd grows by one MSS per ACK, i.e. doubles per RTT.
+		c.cwnd += c.mss
+		return
+	}
+
+	// Congestion avoidance: cwnd += MSS*MSS/cwnd per ACK, i.e. +1 MSS per RTT.
+	c.cwnd += c.mss * c.mss / c.cwnd
+}
+
+func (c *NewReno) OnDupAck() {
+	c.dupAcks++
+	if c.dupAcks != 3 {
+		return
+	}
+
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < c.mss {
+		c.ssthresh = c.mss
+	}
+	c.cwnd = c.ssthresh // fast recovery: skip slow start
+}
+
+func (c *NewReno) OnTimeout() {
+	c.dupAcks = 0
+
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < c.mss {
+		c.ssthresh = c.mss
+	}
+	c.cwnd = c.mss // back to slow start
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// udpDatagramSize is the fixed size of every pooled buffer; it comfortably
+// fits a full SOCKS5-framed UDP datagram.
+const udpDatagramSize = 2048
+
+// udpHeaderReserve is the number of bytes reserved at the front of every
+// pooled buffer for a SOCKS5 UDP header, so prepending one to a received
+// payload never needs a second allocation (the same trick v2ray's buf
+// package uses for its pooled buffers).
+const udpHeaderReserve = 64
+
+var udpBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, udpDatagramSize)
+	},
+}
+
+// MultiBuffer is a batch of pooled, fixed-size buffers used to read or write
+// up to Len() datagrams per syscall via batchReader/batchWriter.
+type MultiBuffer struct {
+	buffers [][]byte
+	lens    []int
+	addrs   []net.Addr
+}
+
+// NewMultiBuffer draws n pooled buffers, each with udpHeaderReserve bytes
+// kept free at the front for a SOCKS5 header.
+func NewMultiBuffer(n int) *MultiBuffer {
+	mb := &MultiBuffer{
+		buffers: make([][]byte, n),
+		lens:    make([]int, n),
+		addrs:   make([]net.Addr, n),
+	}
+
+	for i := range mb.buffers {
+		mb.buffers[i] = udpBufferPool.Get().([]byte)
+	}
+
+	return mb
+}
+
+// Len reports how many buffers mb holds.
+func (mb *MultiBuffer) Len() int { return len(mb.buffers) }
+
+// Payload returns the i-th buffer's datagram content, after the reserved
+// header space.
+func (mb *MultiBuffer) Payload(i int) []byte {
+	return mb.buffers[i][udpHeaderReserve : udpHeaderReserve+mb.lens[i]]
+}
+
+// WithHeader returns the i-th buffer's payload together with n bytes of the
+// reserved header space immediately in front of it, for a zero-copy send.
+func (mb *MultiBuffer) WithHeader(i, n int) []byte {
+	return mb.buffers[i][udpHeaderReserve-n : udpHeaderReserve+mb.lens[i]]
+}
+
+// Release returns every buffer in mb to the shared pool; mb must not be used
+// again afterwards.
+func (mb *MultiBuffer) Release() {
+	for _, b := range mb.buffers {
+		udpBufferPool.Put(b[:udpDatagramSize])
+	}
+	mb.buffers = nil
+}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/common/logg"
@@ -13,20 +15,46 @@ import (
 	"strings"
 )
 
+const (
+	// fragLastFlag marks the final fragment of a SOCKS5 UDP datagram in the
+	// FRAG byte; the low 7 bits carry the fragment's position, starting at 1.
+	fragLastFlag = 0x80
+
+	// defaultFragTimeout bounds how long we wait for all fragments of a
+	// datagram to arrive before discarding the partial reassembly.
+	defaultFragTimeout = 5 * time.Second
+
+	// defaultUDPFragMTU is used when ProxyClient.UDPFragMTU is left unset.
+	defaultUDPFragMTU = 1200
+
+	// defaultUDPBatchSize is used when ProxyClient.UDPBatchSize is left unset.
+	defaultUDPBatchSize = 16
+)
+
 type uAddr struct {
 	ip   net.IP
 	host string
 	port int
 	size int
+
+	// preferV6 governs which address family IP() resolves first when host
+	// is a domain name; set from ProxyClient.UDPPreferIPv6 once the flow's
+	// proxy is known, since parseUDPHeader has no access to it.
+	preferV6 bool
 }
 
 func (a *uAddr) String() string {
 	return a.HostString() + ":" + strconv.Itoa(a.port)
 }
 
+// Network implements net.Addr so a *uAddr (the destination parsed out of a
+// SOCKS5 UDP header) can be used anywhere a net.Addr is expected, such as the
+// fragment-reassembly key.
+func (a *uAddr) Network() string { return "udp" }
+
 func (a *uAddr) HostString() string {
 	if a.ip != nil {
-		if len(a.ip) == net.IPv4len {
+		if a.ip.To4() != nil {
 			return a.ip.String()
 		}
 		return "[" + a.ip.String() + "]"
@@ -39,16 +67,51 @@ func (a *uAddr) HostString() string {
 }
 
 func (a *uAddr) IP() net.IP {
+	return a.ResolveIP(a.preferV6)
+}
+
+// happyEyeballsDelay is how long ResolveIP waits for its preferred address
+// family before racing ahead with the other one, roughly matching the
+// "connection attempt delay" RFC 8305 recommends for Happy Eyeballs.
+const happyEyeballsDelay = 50 * time.Millisecond
+
+// ResolveIP resolves the address's host to an IP, preferring the IPv6
+// family when preferV6 is set and the IPv4 family otherwise. Resolution of
+// the non-preferred family starts after happyEyeballsDelay and is used if it
+// answers first; this is only a resolution race; the caller still does a
+// single Happy-Eyeballs-style dial afterwards.
+func (a *uAddr) ResolveIP(preferV6 bool) net.IP {
 	if a.ip != nil {
 		return a.ip
 	}
 
-	ip, err := net.ResolveIPAddr("ip", a.host)
-	if err != nil {
-		return nil
+	primary, secondary := "ip4", "ip6"
+	if preferV6 {
+		primary, secondary = secondary, primary
+	}
+
+	results := make(chan net.IP, 2)
+
+	resolve := func(network string, delay time.Duration) {
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		addr, err := net.ResolveIPAddr(network, a.host)
+		if err != nil {
+			results <- nil
+			return
+		}
+		results <- addr.IP
 	}
 
-	return ip.IP
+	go resolve(primary, 0)
+	go resolve(secondary, happyEyeballsDelay)
+
+	if ip := <-results; ip != nil {
+		return ip
+	}
+	return <-results
 }
 
 func (a *uAddr) IsAllZeros() bool {
@@ -59,7 +122,7 @@ func (a *uAddr) IsAllZeros() bool {
 	return false
 }
 
-func parseUDPHeader(conn net.Conn, buf []byte, omitCheck bool) (method byte, addr *uAddr, err error) {
+func parseUDPHeader(conn net.Conn, buf []byte, omitCheck bool) (frag byte, addr *uAddr, err error) {
 	var n int
 
 	if buf == nil {
@@ -75,8 +138,11 @@ func parseUDPHeader(conn net.Conn, buf []byte, omitCheck bool) (method byte, add
 			return 0, nil, fmt.Errorf("expect SOCKS5, got %v", buf[0])
 		}
 
-		if buf[1] != 0x01 && buf[1] != 0x03 {
-			return 0, nil, fmt.Errorf("invalid method for UDP relay: %v", buf[1])
+		// buf[1] is FRAG: 0x00 means a standalone datagram, 1..127 is the
+		// fragment's position and the MSB marks the last fragment. The only
+		// value that can never be valid is the MSB set with a zero position.
+		if buf[1] != 0 && buf[1]&^fragLastFlag == 0 {
+			return 0, nil, fmt.Errorf("invalid FRAG for UDP relay: %v", buf[1])
 		}
 	}
 
@@ -117,6 +183,100 @@ func parseUDPHeader(conn net.Conn, buf []byte, omitCheck bool) (method byte, add
 	return buf[1], addr, nil
 }
 
+// fragKey identifies a single logical SOCKS5 UDP datagram being reassembled
+// from the fragments a client sent to us.
+type fragKey struct {
+	src string
+	dst string
+}
+
+// fragAssembly is the in-progress reassembly state for one fragKey.
+type fragAssembly struct {
+	next  byte // next fragment position we expect, positions start at 1
+	buf   []byte
+	timer *time.Timer
+}
+
+// udpFragReassembler reassembles FRAG-tagged SOCKS5 UDP datagrams before they
+// are forwarded upstream. A reassembly that stalls for longer than timeout,
+// or that receives a fragment out of order, is discarded entirely.
+type udpFragReassembler struct {
+	mu      sync.Mutex
+	parts   map[fragKey]*fragAssembly
+	timeout time.Duration
+	logger  *logg.Logger
+}
+
+func newUDPFragReassembler(timeout time.Duration, logger *logg.Logger) *udpFragReassembler {
+	if timeout <= 0 {
+		timeout = defaultFragTimeout
+	}
+
+	return &udpFragReassembler{
+		parts:   make(map[fragKey]*fragAssembly),
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// feed processes one datagram's FRAG byte and payload. It returns the
+// reassembled payload and true once a complete datagram is available: either
+// immediately for a standalone (FRAG 0x00) datagram, or once the fragment
+// with the MSB set arrives in order.
+func (r *udpFragReassembler) feed(src, dst net.Addr, frag byte, payload []byte) ([]byte, bool) {
+	if frag == 0 {
+		return payload, true
+	}
+
+	key := fragKey{src: src.String(), dst: dst.String()}
+	seq := frag &^ fragLastFlag
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := r.parts[key]
+	if seq == 1 {
+		if a != nil {
+			a.timer.Stop()
+		}
+
+		a = &fragAssembly{next: 2, buf: append([]byte{}, payload...)}
+		r.parts[key] = a
+		r.armTimeout(key, a)
+	} else {
+		if a == nil || seq != a.next {
+			r.logger.Dbgf("UDP fragment out of order for %v, discarding datagram", key)
+			if a != nil {
+				a.timer.Stop()
+				delete(r.parts, key)
+			}
+			return nil, false
+		}
+
+		a.buf = append(a.buf, payload...)
+		a.next++
+	}
+
+	if frag&fragLastFlag == 0 {
+		return nil, false
+	}
+
+	a.timer.Stop()
+	delete(r.parts, key)
+	return a.buf, true
+}
+
+func (r *udpFragReassembler) armTimeout(key fragKey, a *fragAssembly) {
+	a.timer = time.AfterFunc(r.timeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.parts[key] == a {
+			r.logger.Dbgf("UDP fragment reassembly for %v timed out", key)
+			delete(r.parts, key)
+		}
+	})
+}
+
 type udpBridgeConn struct {
 	*net.UDPConn
 	udpSrc net.Addr
@@ -131,8 +291,31 @@ type udpBridgeConn struct {
 
 	incompleteLen bool
 	socks         bool
-	closed        bool
-	dst           *uAddr
+
+	// closeMu guards closed and the inbound channel: deliver and Close both
+	// take it before touching either, so a send into inbound can never race
+	// Close's close(inbound) and panic.
+	closeMu sync.Mutex
+	closed  bool
+	dst     *uAddr
+
+	// fragMTU bounds the size of a single datagram written back to the
+	// SOCKS5 client; larger payloads are split into numbered FRAG fragments.
+	fragMTU int
+
+	// inbound, when set, delivers datagrams dispatched to this connection by
+	// a shared udpConnTrack instead of Read calling UDPConn.ReadFrom itself;
+	// this lets several flows share one relay socket without racing each
+	// other for packets that belong to a different flow. idleTimeout bounds
+	// how long Read waits before giving up, mirroring a read deadline.
+	inbound     chan []byte
+	idleTimeout time.Duration
+
+	// batchWriter, when set, is used by writeFragmented to send a fragmented
+	// datagram's pieces as a single sendmmsg-style batch instead of one
+	// WriteTo syscall per fragment; it is shared by every connection using
+	// the same relay socket.
+	batchWriter *batchWriter
 }
 
 func (c *udpBridgeConn) Read(b []byte) (n int, err error) {
@@ -148,6 +331,19 @@ func (c *udpBridgeConn) Read(b []byte) (n int, err error) {
 		goto PUT_HEADER
 	}
 
+	if c.inbound != nil {
+		select {
+		case payload, ok := <-c.inbound:
+			if !ok {
+				return 0, io.EOF
+			}
+			n = copy(b[2:], payload)
+			goto PUT_HEADER
+		case <-time.After(c.idleTimeout):
+			return 0, fmt.Errorf("udpBridgeConn idle for %v", c.idleTimeout)
+		}
+	}
+
 	n, c.udpSrc, err = c.UDPConn.ReadFrom(b) // We assume that src never change
 	if err != nil {
 		return
@@ -186,37 +382,163 @@ func (c *udpBridgeConn) write(b []byte) (n int, err error) {
 		return
 	}
 
-	xbuf := make([]byte, len(b)+256)
-	ln := 0
+	mtu := c.fragMTU
+	if mtu <= 0 {
+		mtu = defaultUDPFragMTU
+	}
+
+	if len(b) <= mtu {
+		return c.writeFrag(b, 0)
+	}
+
+	return c.writeFragmented(b, mtu)
+}
+
+// writeFragmented splits a return-path datagram larger than mtu into
+// properly numbered SOCKS5 UDP fragments (FRAG 1..127, the last one with the
+// MSB set) so that fragmenting SOCKS5 clients can reassemble it. The
+// fragments are handed to the shared batchWriter as one batch instead of one
+// WriteTo syscall each.
+func (c *udpBridgeConn) writeFragmented(b []byte, mtu int) (n int, err error) {
+	const maxFragments = fragLastFlag - 1
+
+	chunks := (len(b) + mtu - 1) / mtu
+	if chunks > maxFragments {
+		// Too large to number within the SOCKS5 FRAG space; send as a
+		// single oversized datagram rather than fragment incorrectly.
+		c.logger.Warnf("UDP datagram too large to fragment (%d bytes), sending unfragmented", len(b))
+		return c.writeFrag(b, 0)
+	}
+
+	if c.batchWriter == nil {
+		return c.writeFragmentedLoop(b, mtu, chunks)
+	}
+
+	// The header length only depends on c.dst, not on which fragment this
+	// is; probe it once so an oversized domain header (longer than the
+	// pool's reserved header room) falls back to the unbatched path instead
+	// of underflowing the reserve in the loop below.
+	var probeHdr [262]byte
+	if hl := c.encodeHeader(probeHdr[:], 0); hl > udpHeaderReserve {
+		return c.writeFragmentedLoop(b, mtu, chunks)
+	}
+
+	mb := NewMultiBuffer(chunks)
+	defer mb.Release()
+
+	hdrLens := make([]int, chunks)
+	addrs := make([]net.Addr, chunks)
 
+	for i := 0; i < chunks; i++ {
+		lo, hi := i*mtu, (i+1)*mtu
+		if hi > len(b) {
+			hi = len(b)
+		}
+
+		frag := byte(i + 1)
+		if i == chunks-1 {
+			frag |= fragLastFlag
+		}
+
+		var hdr [262]byte
+		hl := c.encodeHeader(hdr[:], frag)
+
+		copy(mb.buffers[i][udpHeaderReserve:], b[lo:hi])
+		mb.lens[i] = hi - lo
+		copy(mb.buffers[i][udpHeaderReserve-hl:udpHeaderReserve], hdr[:hl])
+
+		hdrLens[i] = hl
+		addrs[i] = c.udpSrc
+	}
+
+	sent, werr := c.batchWriter.WriteBatch(mb, chunks, hdrLens, addrs)
+	for i := 0; i < sent; i++ {
+		n += mb.lens[i]
+	}
+	if werr != nil {
+		return n, werr
+	}
+	return n, nil
+}
+
+// writeFragmentedLoop is the pre-batching fallback, used when this
+// connection has no shared batchWriter.
+func (c *udpBridgeConn) writeFragmentedLoop(b []byte, mtu int, chunks int) (n int, err error) {
+	for i := 0; i < chunks; i++ {
+		lo, hi := i*mtu, (i+1)*mtu
+		if hi > len(b) {
+			hi = len(b)
+		}
+
+		frag := byte(i + 1)
+		if i == chunks-1 {
+			frag |= fragLastFlag
+		}
+
+		wn, werr := c.writeFrag(b[lo:hi], frag)
+		if werr != nil {
+			return n, werr
+		}
+		n += wn
+	}
+
+	return n, nil
+}
+
+// encodeHeader writes the return-path SOCKS5 UDP header (version, FRAG,
+// address type, address, port) for frag into dst, which must have at least
+// 262 bytes of room (the longest, 255-byte domain header), and returns how
+// many bytes it used.
+func (c *udpBridgeConn) encodeHeader(dst []byte, frag byte) (ln int) {
 	if c.dst.host != "" {
 		hl := len(c.dst.host)
 
-		xbuf[3] = 0x03
-		xbuf[4] = byte(hl)
-		copy(xbuf[5:], []byte(c.dst.host))
+		dst[3] = 0x03
+		dst[4] = byte(hl)
+		copy(dst[5:], []byte(c.dst.host))
 
-		binary.BigEndian.PutUint16(xbuf[5+hl:], uint16(c.dst.port))
+		binary.BigEndian.PutUint16(dst[5+hl:], uint16(c.dst.port))
 		ln = 5 + hl + 2
-		copy(xbuf[ln:], b)
-		//
-	} else if len(c.dst.ip) == net.IPv4len {
+
+	} else if ip4 := c.dst.ip.To4(); ip4 != nil {
+		// A v4-in-v6-mapped net.IP still has len() == net.IPv6len, so the
+		// family must be decided by To4() rather than the raw byte length.
 		ln = len(udpHeaderIPv4)
 
-		copy(xbuf, udpHeaderIPv4)
-		copy(xbuf[4:8], c.dst.ip)
-		binary.BigEndian.PutUint16(xbuf[8:], uint16(c.dst.port))
-		copy(xbuf[ln:], b)
+		copy(dst, udpHeaderIPv4)
+		copy(dst[4:8], ip4)
+		binary.BigEndian.PutUint16(dst[8:], uint16(c.dst.port))
 
 	} else {
 		ln = len(udpHeaderIPv6)
 
-		copy(xbuf, udpHeaderIPv6)
-		copy(xbuf[4:20], c.dst.ip)
-		binary.BigEndian.PutUint16(xbuf[20:], uint16(c.dst.port))
-		copy(xbuf[ln:], b)
+		copy(dst, udpHeaderIPv6)
+		copy(dst[4:20], c.dst.ip.To16())
+		binary.BigEndian.PutUint16(dst[20:], uint16(c.dst.port))
 	}
 
+	// the header templates above already carry their own version/FRAG
+	// bytes at [0:2]; re-apply ours since this datagram may be a fragment.
+	dst[0] = socksVersion5
+	dst[1] = frag
+	return
+}
+
+func (c *udpBridgeConn) writeFrag(b []byte, frag byte) (n int, err error) {
+	// Reuse a pooled buffer instead of allocating a fresh one per datagram;
+	// fall back to make() for the rare oversized write that doesn't fit.
+	var xbuf []byte
+	pooled := len(b)+262 <= udpDatagramSize
+	if pooled {
+		xbuf = udpBufferPool.Get().([]byte)
+		defer udpBufferPool.Put(xbuf)
+	} else {
+		xbuf = make([]byte, len(b)+262)
+	}
+
+	ln := c.encodeHeader(xbuf, frag)
+	copy(xbuf[ln:], b)
+
 	n, err = c.WriteTo(xbuf[:ln+len(b)], c.udpSrc)
 	if err == nil {
 		n += 2 - ln
@@ -308,76 +630,300 @@ TEST:
 }
 
 func (c *udpBridgeConn) Close() error {
+	c.closeMu.Lock()
+	if c.closed {
+		c.closeMu.Unlock()
+		return nil
+	}
 	c.closed = true
+
+	if c.inbound != nil {
+		// relay is the physical socket shared by every flow on this client;
+		// closing it here would kill every other concurrent destination, so
+		// just stop delivering to this connection instead.
+		close(c.inbound)
+		c.closeMu.Unlock()
+		return nil
+	}
+	c.closeMu.Unlock()
+
 	return c.UDPConn.Close()
 }
 
-func (proxy *ProxyClient) handleUDPtoTCP(relay *net.UDPConn, client net.Conn) {
-	defer relay.Close()
-	defer client.Close()
+// deliver hands payload to this connection's inbound channel, dropping it
+// instead of sending if the connection is already closed. It takes the same
+// lock Close does so a concurrent Close can't close(inbound) while a send
+// into it is in flight, which would panic.
+func (c *udpBridgeConn) deliver(payload []byte) bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
 
-	// prepare the response to answer the client
-	response, port := make([]byte, len(okSOCKS)), relay.LocalAddr().(*net.UDPAddr).Port
+	if c.closed {
+		return false
+	}
 
-	copy(response, okSOCKS)
-	binary.BigEndian.PutUint16(response[8:], uint16(port))
-	client.Write(response)
+	select {
+	case c.inbound <- payload:
+		return true
+	default:
+		// The upstream coconn is falling behind; drop rather than block
+		// the shared relay read loop for every other flow.
+		return false
+	}
+}
 
-	buf := make([]byte, 2048)
-	n, src, err := relay.ReadFrom(buf)
-	if err != nil {
-		proxy.Logger.Errorf("Can't read initial UDP packet: %v", err)
+// defaultUDPConnTrackTimeout is used when ProxyClient.UDPConnTrackTimeout is
+// left unset; it mirrors the idle timeout Docker's userland UDP proxy uses.
+const defaultUDPConnTrackTimeout = 90 * time.Second
+
+// udpFlowKey identifies one client-to-destination UDP flow sharing a single
+// relay socket, analogous to a 3-tuple in a NAT/conntrack table.
+type udpFlowKey struct {
+	client string
+	host   string
+	port   int
+}
+
+// udpFlow owns the upstream tunnel connection(s) dialed for one flow and the
+// timestamp of its last activity, so the janitor can evict it once idle.
+type udpFlow struct {
+	srcs        []*udpBridgeConn
+	conns       []net.Conn
+	rr          uint32
+	idleTimeout time.Duration
+	lastSeen    int64 // unix nano, accessed atomically
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastSeen, time.Now().UnixNano())
+
+	if f.idleTimeout <= 0 {
 		return
 	}
 
-	_, dst, err := parseUDPHeader(nil, buf[:n], true)
-	if err != nil {
-		proxy.Logger.Errorf("UDP parse: %v", err)
-		return
+	// Refresh each upstream tunnel's read deadline too, so a reader blocked
+	// on it unblocks on the same idle schedule the janitor uses, instead of
+	// only ever being woken by the eventual Close() below.
+	deadline := time.Now().Add(f.idleTimeout)
+	for _, c := range f.conns {
+		if c != nil {
+			c.SetReadDeadline(deadline)
+		}
 	}
+}
 
-	proxy.Logger.Logf("UDP relay server listen at %d", port)
-	proxy.Logger.Logf("UDP destination: %s", dst.String())
+func (f *udpFlow) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.lastSeen)))
+}
+
+// dispatch hands payload to one of the flow's upstream connections, picked
+// round-robin the same way the relay socket used to distribute packets
+// across coconns by racing their ReadFrom calls.
+func (f *udpFlow) dispatch(payload []byte) {
+	idx := int(atomic.AddUint32(&f.rr, 1)-1) % len(f.srcs)
+	f.srcs[idx].deliver(payload)
+}
+
+func (f *udpFlow) close() {
+	for _, s := range f.srcs {
+		s.Close()
+	}
+	for _, c := range f.conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+// udpConnTrack is a connection-tracking table keyed by udpFlowKey, lazily
+// creating a udpFlow on first packet and evicting it once idle for longer
+// than timeout.
+type udpConnTrack struct {
+	mu      sync.Mutex
+	flows   map[udpFlowKey]*udpFlow
+	timeout time.Duration
+	logger  *logg.Logger
+}
+
+func newUDPConnTrack(timeout time.Duration, logger *logg.Logger) *udpConnTrack {
+	if timeout <= 0 {
+		timeout = defaultUDPConnTrackTimeout
+	}
+
+	return &udpConnTrack{
+		flows:   make(map[udpFlowKey]*udpFlow),
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// getOrCreate returns the tracked flow for key, creating it via create if it
+// doesn't exist yet.
+func (t *udpConnTrack) getOrCreate(key udpFlowKey, create func() *udpFlow) (flow *udpFlow, created bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if f, ok := t.flows[key]; ok {
+		return f, false
+	}
+
+	f := create()
+	t.flows[key] = f
+	return f, true
+}
+
+// janitor periodically evicts idle flows until stop is closed.
+func (t *udpConnTrack) janitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.timeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			t.sweep()
+		}
+	}
+}
+
+func (t *udpConnTrack) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, f := range t.flows {
+		if f.idleFor() > t.timeout {
+			t.logger.Dbgf("UDP flow %v idle for %v, evicting", key, f.idleFor())
+			delete(t.flows, key)
+			go f.close()
+		}
+	}
+}
+
+func (t *udpConnTrack) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
+	for key, f := range t.flows {
+		delete(t.flows, key)
+		f.close()
+	}
+}
+
+func (proxy *ProxyClient) newUDPFlow(relay *net.UDPConn, src net.Addr, dst *uAddr, idleTimeout time.Duration, writer *batchWriter) *udpFlow {
 	maxConns := int(proxy.UDPRelayCoconn)
-	srcs := make([]*udpBridgeConn, maxConns)
-	conns := make([]net.Conn, maxConns)
+	if maxConns <= 0 {
+		maxConns = 1
+	}
+
+	f := &udpFlow{srcs: make([]*udpBridgeConn, maxConns), conns: make([]net.Conn, maxConns), idleTimeout: idleTimeout}
 
 	for i := 0; i < maxConns; i++ {
-		srcs[i] = &udpBridgeConn{
-			UDPConn: relay,
-			socks:   true,
-			udpSrc:  src,
-			dst:     dst,
-			logger:  proxy.Logger,
+		f.srcs[i] = &udpBridgeConn{
+			UDPConn:     relay,
+			socks:       true,
+			udpSrc:      src,
+			dst:         dst,
+			logger:      proxy.Logger,
+			fragMTU:     int(proxy.UDPFragMTU),
+			inbound:     make(chan []byte, 8),
+			idleTimeout: idleTimeout,
+			batchWriter: writer,
 		}
 
-		if i == 0 {
-			// The first connection will be responsible for sending the initial buffer
-			srcs[0].initBuf = buf[dst.size:n]
+		var conn net.Conn
+		var err error
+
+		if proxy.UDPTransport == UDPTransportReliable {
+			conn, err = proxy.newReliableUpstream(f.srcs[i], dst.String())
+		} else {
+			conn, err = proxy.DialUpstream(f.srcs[i], dst.String(), nil, doUDPRelay, 0)
 		}
 
-		conns[i], err = proxy.DialUpstream(srcs[i], dst.String(), nil, doUDPRelay, 0)
 		if err != nil {
 			proxy.Logger.Errorf("UDP DialUpstream failed: %v", err)
 		}
+		f.conns[i] = conn
 	}
 
-	// Connections may be double closed, so we manually check them
+	f.touch()
+	return f
+}
+
+func (proxy *ProxyClient) handleUDPtoTCP(relay *net.UDPConn, client net.Conn) {
+	defer relay.Close()
+	defer client.Close()
+
+	// prepare the response to answer the client
+	response, port := make([]byte, len(okSOCKS)), relay.LocalAddr().(*net.UDPAddr).Port
+
+	copy(response, okSOCKS)
+	binary.BigEndian.PutUint16(response[8:], uint16(port))
+	client.Write(response)
+
+	proxy.Logger.Logf("UDP relay server listen at %d", port)
+
+	idleTimeout := proxy.UDPConnTrackTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPConnTrackTimeout
+	}
+
+	track := newUDPConnTrack(idleTimeout, proxy.Logger)
+	stop := make(chan struct{})
+	go track.janitor(stop)
+
+	defer close(stop)
+	defer track.closeAll()
+
+	// Reassembles fragmented datagrams before they're dispatched to a flow;
+	// fragments are keyed by (src, dst) so concurrent flows don't interfere.
+	reassembler := newUDPFragReassembler(proxy.UDPFragTimeout, proxy.Logger)
+
+	batchSize := int(proxy.UDPBatchSize)
+	if batchSize <= 0 {
+		batchSize = defaultUDPBatchSize
+	}
+
+	reader := newBatchReader(relay)
+	writer := newBatchWriter(relay)
+	mb := NewMultiBuffer(batchSize)
+	defer mb.Release()
+
 	for {
-		count := 0
-		for _, src := range srcs {
-			if src.closed {
-				count++
-			}
+		n, err := reader.ReadBatch(mb)
+		if err != nil {
+			proxy.Logger.Errorf("UDP relay read failed: %v", err)
+			return
 		}
 
-		if count == maxConns {
-			break
-		}
+		for i := 0; i < n; i++ {
+			src, datagram := mb.addrs[i], mb.Payload(i)
 
-		time.Sleep(time.Second)
-	}
+			frag, dst, err := parseUDPHeader(nil, datagram, true)
+			if err != nil {
+				proxy.Logger.Errorf("UDP parse: %v", err)
+				continue
+			}
+			dst.preferV6 = proxy.UDPPreferIPv6
+
+			payload, ok := reassembler.feed(src, dst, frag, append([]byte(nil), datagram[dst.size:]...))
+			if !ok {
+				continue
+			}
 
-	proxy.Logger.Dbgf("Close UDP relay server at %d", port)
+			key := udpFlowKey{client: src.String(), host: dst.HostString(), port: dst.port}
+
+			flow, created := track.getOrCreate(key, func() *udpFlow {
+				return proxy.newUDPFlow(relay, src, dst, idleTimeout, writer)
+			})
+
+			if created {
+				proxy.Logger.Logf("UDP new flow %s -> %s", key.client, dst.String())
+			} else {
+				flow.touch()
+			}
+
+			flow.dispatch(payload)
+		}
+	}
 }
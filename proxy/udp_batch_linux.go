@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// batchReader performs batched UDP reads, using recvmmsg under the hood via
+// golang.org/x/net/ipv4 on Linux.
+type batchReader struct {
+	pc *ipv4.PacketConn
+}
+
+func newBatchReader(conn *net.UDPConn) *batchReader {
+	return &batchReader{pc: ipv4.NewPacketConn(conn)}
+}
+
+// ReadBatch fills mb with up to mb.Len() datagrams in a single syscall,
+// returning how many were actually read.
+func (r *batchReader) ReadBatch(mb *MultiBuffer) (int, error) {
+	msgs := make([]ipv4.Message, mb.Len())
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{mb.buffers[i][udpHeaderReserve:]}
+	}
+
+	n, err := r.pc.ReadBatch(msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		mb.lens[i] = msgs[i].N
+		mb.addrs[i] = msgs[i].Addr
+	}
+
+	return n, nil
+}
+
+// batchWriter performs batched UDP writes, using sendmmsg under the hood via
+// golang.org/x/net/ipv4 on Linux.
+type batchWriter struct {
+	pc *ipv4.PacketConn
+}
+
+func newBatchWriter(conn *net.UDPConn) *batchWriter {
+	return &batchWriter{pc: ipv4.NewPacketConn(conn)}
+}
+
+// WriteBatch sends the first n datagrams of mb, each with hdrLens[i] bytes
+// of header immediately prepended via WithHeader and sent to addrs[i], in as
+// few syscalls as sendmmsg allows.
+func (w *batchWriter) WriteBatch(mb *MultiBuffer, n int, hdrLens []int, addrs []net.Addr) (int, error) {
+	msgs := make([]ipv4.Message, n)
+	for i := 0; i < n; i++ {
+		msgs[i].Buffers = [][]byte{mb.WithHeader(i, hdrLens[i])}
+		msgs[i].Addr = addrs[i]
+	}
+
+	return w.pc.WriteBatch(msgs, 0)
+}
@@ -0,0 +1,72 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// batchReader is the portable fallback for platforms without recvmmsg: it
+// blocks for the first datagram, then opportunistically drains whatever
+// else is already queued (via a read deadline of now) instead of one batched
+// syscall.
+type batchReader struct {
+	conn *net.UDPConn
+}
+
+func newBatchReader(conn *net.UDPConn) *batchReader {
+	return &batchReader{conn: conn}
+}
+
+// ReadBatch fills mb with up to mb.Len() datagrams.
+func (r *batchReader) ReadBatch(mb *MultiBuffer) (int, error) {
+	n, addr, err := r.conn.ReadFrom(mb.buffers[0][udpHeaderReserve:])
+	if err != nil {
+		return 0, err
+	}
+	mb.lens[0] = n
+	mb.addrs[0] = addr
+
+	count := 1
+	for count < mb.Len() {
+		r.conn.SetReadDeadline(time.Now())
+
+		n, addr, err := r.conn.ReadFrom(mb.buffers[count][udpHeaderReserve:])
+		if err != nil {
+			break
+		}
+
+		mb.lens[count] = n
+		mb.addrs[count] = addr
+		count++
+	}
+	r.conn.SetReadDeadline(time.Time{})
+
+	return count, nil
+}
+
+// batchWriter is the portable fallback for platforms without sendmmsg: it
+// loops plain WriteTo calls instead of one batched syscall.
+type batchWriter struct {
+	conn *net.UDPConn
+}
+
+func newBatchWriter(conn *net.UDPConn) *batchWriter {
+	return &batchWriter{conn: conn}
+}
+
+// WriteBatch sends the first n datagrams of mb, each with hdrLens[i] bytes
+// of header immediately prepended via WithHeader and sent to addrs[i].
+func (w *batchWriter) WriteBatch(mb *MultiBuffer, n int, hdrLens []int, addrs []net.Addr) (int, error) {
+	sent := 0
+	for i := 0; i < n; i++ {
+		if _, err := w.conn.WriteTo(mb.WithHeader(i, hdrLens[i]), addrs[i]); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
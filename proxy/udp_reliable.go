@@ -0,0 +1,471 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coyove/common/logg"
+)
+
+// UDPTransportMode selects how UDP payloads travel between the client and
+// server proxies.
+type UDPTransportMode int
+
+const (
+	// UDPTransportRaw relays UDP payloads over the upstream tunnel as-is;
+	// this is the historical, fire-and-forget behavior.
+	UDPTransportRaw UDPTransportMode = iota
+
+	// UDPTransportReliable wraps the upstream tunnel in a reliableConn,
+	// adding sequence numbers, cumulative/selective ACKs, RTO-driven
+	// retransmission and NewReno congestion control.
+	UDPTransportReliable
+)
+
+const (
+	reliablePacketData byte = iota
+	reliablePacketAck
+)
+
+// reliableHeaderSize is the fixed portion of a reliable packet: type(1) +
+// seq(4) + ack(4) + sackCount(1).
+const reliableHeaderSize = 1 + 4 + 4 + 1
+
+// reliableMSS bounds how many payload bytes a single reliable packet carries.
+const reliableMSS = 1200
+
+// reliableMaxSacks bounds how many selective acks are carried per packet.
+const reliableMaxSacks = 8
+
+func encodeReliablePacket(typ byte, seq, ack uint32, sacks []uint32, payload []byte) []byte {
+	buf := make([]byte, reliableHeaderSize+4*len(sacks)+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], seq)
+	binary.BigEndian.PutUint32(buf[5:], ack)
+	buf[9] = byte(len(sacks))
+
+	off := reliableHeaderSize
+	for _, s := range sacks {
+		binary.BigEndian.PutUint32(buf[off:], s)
+		off += 4
+	}
+
+	copy(buf[off:], payload)
+	return buf
+}
+
+func decodeReliablePacket(buf []byte) (typ byte, seq, ack uint32, sacks []uint32, payload []byte, err error) {
+	if len(buf) < reliableHeaderSize {
+		return 0, 0, 0, nil, nil, fmt.Errorf("reliable packet too short: %d bytes", len(buf))
+	}
+
+	typ = buf[0]
+	seq = binary.BigEndian.Uint32(buf[1:])
+	ack = binary.BigEndian.Uint32(buf[5:])
+	sackCount := int(buf[9])
+
+	off := reliableHeaderSize
+	if len(buf) < off+4*sackCount {
+		return 0, 0, 0, nil, nil, fmt.Errorf("reliable packet truncated sacks")
+	}
+
+	sacks = make([]uint32, sackCount)
+	for i := range sacks {
+		sacks[i] = binary.BigEndian.Uint32(buf[off:])
+		off += 4
+	}
+
+	return typ, seq, ack, sacks, buf[off:], nil
+}
+
+// rttEstimator implements the Jacobson/Karn RTO estimator: a smoothed RTT
+// and mean deviation, combined into a timeout with backoff-friendly bounds.
+// Samples from retransmitted packets must not be fed in (Karn's algorithm).
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	inited bool
+}
+
+func newRTTEstimator() *rttEstimator {
+	return &rttEstimator{rto: time.Second}
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+
+	if !e.inited {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.inited = true
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = e.rttvar - e.rttvar/4 + diff/4
+		e.srtt = e.srtt - e.srtt/8 + rtt/8
+	}
+
+	e.rto = e.srtt + 4*e.rttvar
+	if e.rto < 200*time.Millisecond {
+		e.rto = 200 * time.Millisecond
+	} else if e.rto > 60*time.Second {
+		e.rto = 60 * time.Second
+	}
+}
+
+func (e *rttEstimator) timeout() time.Duration { return e.rto }
+
+// outPacket is a sent-but-not-yet-acknowledged reliable packet.
+type outPacket struct {
+	payload     []byte
+	sentAt      time.Time
+	retransmits int
+}
+
+// reliableConn turns a lossy, packet-oriented net.Conn into an ordered,
+// congestion-controlled byte stream: writes are split into reliableMSS
+// chunks and numbered, acknowledgments (cumulative + selective) drive
+// retransmission and the Congestion controller, and reassembled bytes are
+// delivered to Read in order.
+type reliableConn struct {
+	conn   net.Conn
+	logger *logg.Logger
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	cong          Congestion
+	rtt           *rttEstimator
+	nextSeq       uint32
+	inflight      map[uint32]*outPacket
+	inflightBytes int
+	closed        bool
+	closeCh       chan struct{}
+
+	recvMu   sync.Mutex
+	recvNext uint32
+	recvBuf  map[uint32][]byte
+}
+
+func newReliableConn(conn net.Conn, logger *logg.Logger) *reliableConn {
+	pr, pw := io.Pipe()
+
+	c := &reliableConn{
+		conn:     conn,
+		logger:   logger,
+		pr:       pr,
+		pw:       pw,
+		cong:     NewNewReno(reliableMSS),
+		rtt:      newRTTEstimator(),
+		inflight: make(map[uint32]*outPacket),
+		recvBuf:  make(map[uint32][]byte),
+		closeCh:  make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	go c.recvLoop()
+	go c.retransmitLoop()
+
+	return c
+}
+
+func (c *reliableConn) Read(b []byte) (int, error) { return c.pr.Read(b) }
+
+func (c *reliableConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > reliableMSS {
+			chunk = b[:reliableMSS]
+		}
+
+		if err = c.sendChunk(chunk); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// sendChunk blocks until the congestion window has room, then sends chunk as
+// a newly numbered data packet.
+func (c *reliableConn) sendChunk(payload []byte) error {
+	c.mu.Lock()
+	for c.inflightBytes >= c.cong.Cwnd() && !c.closed {
+		c.cond.Wait()
+	}
+
+	if c.closed {
+		c.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+
+	seq := c.nextSeq
+	c.nextSeq++
+
+	buf := append([]byte(nil), payload...)
+	c.inflight[seq] = &outPacket{payload: buf, sentAt: time.Now()}
+	c.inflightBytes += len(buf)
+	c.mu.Unlock()
+
+	return c.sendPacket(reliablePacketData, seq, buf)
+}
+
+func (c *reliableConn) sendPacket(typ byte, seq uint32, payload []byte) error {
+	c.recvMu.Lock()
+	ack := c.recvNext
+	sacks := c.pendingSacks()
+	c.recvMu.Unlock()
+
+	_, err := c.conn.Write(encodeReliablePacket(typ, seq, ack, sacks, payload))
+	return err
+}
+
+func (c *reliableConn) sendAck() {
+	if err := c.sendPacket(reliablePacketAck, 0, nil); err != nil {
+		c.logger.Dbgf("reliableConn: ack send failed: %v", err)
+	}
+}
+
+// pendingSacks reports the out-of-order sequence numbers currently buffered,
+// capped to reliableMaxSacks entries.
+func (c *reliableConn) pendingSacks() []uint32 {
+	if len(c.recvBuf) == 0 {
+		return nil
+	}
+
+	sacks := make([]uint32, 0, len(c.recvBuf))
+	for seq := range c.recvBuf {
+		sacks = append(sacks, seq)
+	}
+	sort.Slice(sacks, func(i, j int) bool { return sacks[i] < sacks[j] })
+
+	if len(sacks) > reliableMaxSacks {
+		sacks = sacks[:reliableMaxSacks]
+	}
+	return sacks
+}
+
+func (c *reliableConn) recvLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.logger.Dbgf("reliableConn: recv loop exiting: %v", err)
+			c.Close()
+			return
+		}
+
+		typ, seq, ack, sacks, payload, err := decodeReliablePacket(buf[:n])
+		if err != nil {
+			c.logger.Warnf("reliableConn: %v", err)
+			continue
+		}
+
+		c.handleAck(ack, sacks)
+
+		if typ == reliablePacketData {
+			c.handleData(seq, payload)
+		}
+	}
+}
+
+func (c *reliableConn) handleAck(ack uint32, sacks []uint32) {
+	c.mu.Lock()
+
+	advanced := false
+	ackOne := func(seq uint32) {
+		p, ok := c.inflight[seq]
+		if !ok {
+			return
+		}
+
+		c.inflightBytes -= len(p.payload)
+		delete(c.inflight, seq)
+		if p.retransmits == 0 {
+			// Karn's algorithm: never sample RTT off a retransmitted packet.
+			c.rtt.sample(time.Since(p.sentAt))
+		}
+		c.cong.OnAck(len(p.payload))
+		advanced = true
+	}
+
+	for seq := range c.inflight {
+		if seq < ack {
+			ackOne(seq)
+		}
+	}
+	for _, seq := range sacks {
+		ackOne(seq)
+	}
+
+	if !advanced {
+		c.cong.OnDupAck()
+	}
+
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+func (c *reliableConn) handleData(seq uint32, payload []byte) {
+	c.recvMu.Lock()
+
+	if seq < c.recvNext {
+		// Already delivered; the client probably missed our ack, resend it.
+		c.recvMu.Unlock()
+		c.sendAck()
+		return
+	}
+
+	if _, dup := c.recvBuf[seq]; !dup {
+		c.recvBuf[seq] = append([]byte(nil), payload...)
+	}
+
+	var deliver [][]byte
+	for {
+		chunk, ok := c.recvBuf[c.recvNext]
+		if !ok {
+			break
+		}
+		deliver = append(deliver, chunk)
+		delete(c.recvBuf, c.recvNext)
+		c.recvNext++
+	}
+	c.recvMu.Unlock()
+
+	for _, chunk := range deliver {
+		if _, err := c.pw.Write(chunk); err != nil {
+			return
+		}
+	}
+
+	c.sendAck()
+}
+
+func (c *reliableConn) retransmitLoop() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closeCh:
+			return
+		case <-ticker.C:
+			c.retransmitExpired()
+		}
+	}
+}
+
+func (c *reliableConn) retransmitExpired() {
+	c.mu.Lock()
+	rto := c.rtt.timeout()
+
+	var expired []uint32
+	for seq, p := range c.inflight {
+		if time.Since(p.sentAt) > rto {
+			expired = append(expired, seq)
+		}
+	}
+
+	if len(expired) > 0 {
+		c.cong.OnTimeout()
+	}
+
+	resend := make(map[uint32][]byte, len(expired))
+	for _, seq := range expired {
+		p := c.inflight[seq]
+		p.sentAt = time.Now()
+		p.retransmits++
+		resend[seq] = p.payload
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	for seq, payload := range resend {
+		if err := c.sendPacket(reliablePacketData, seq, payload); err != nil {
+			c.logger.Dbgf("reliableConn: retransmit of %d failed: %v", seq, err)
+		}
+	}
+}
+
+func (c *reliableConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.closeCh)
+	c.cond.Broadcast()
+	c.pw.Close()
+	c.pr.Close()
+	return c.conn.Close()
+}
+
+func (c *reliableConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *reliableConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *reliableConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *reliableConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *reliableConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// bridgeConns copies bytes in both directions between a and b until either
+// side's copy returns, then closes both.
+func bridgeConns(a, b net.Conn, logger *logg.Logger) {
+	done := make(chan struct{}, 2)
+
+	cp := func(dst io.Writer, src io.Reader) {
+		if _, err := io.Copy(dst, src); err != nil {
+			logger.Dbgf("bridgeConns: %v", err)
+		}
+		done <- struct{}{}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// newReliableUpstream dials the upstream tunnel via DialUpstream and wraps it
+// in a reliableConn. DialUpstream pumps its downstream argument directly
+// against the raw conn it dials, so wrapping that raw conn in a reliableConn
+// after DialUpstream returns would race DialUpstream's own pump for every
+// byte, including the first. Instead we hand DialUpstream one end of an
+// in-memory pipe as its downstream: DialUpstream's pump transparently relays
+// bytes between the pipe and the real raw conn, which it keeps exclusive
+// ownership of, and we wrap the pipe's other end in the reliableConn, which
+// nothing else ever reads from or writes to.
+func (proxy *ProxyClient) newReliableUpstream(downstream net.Conn, addr string) (net.Conn, error) {
+	ours, theirs := net.Pipe()
+
+	_, err := proxy.DialUpstream(theirs, addr, nil, doUDPRelay, 0)
+	if err != nil {
+		ours.Close()
+		theirs.Close()
+		return nil, err
+	}
+
+	reliable := newReliableConn(ours, proxy.Logger)
+	go bridgeConns(downstream, reliable, proxy.Logger)
+
+	return reliable, nil
+}
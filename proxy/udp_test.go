@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// TestUDPHeaderIPv6RoundTrip parses an inbound SOCKS5 UDP datagram addressed
+// to an IPv6 literal, then writes a reply back through udpBridgeConn.write
+// and parses that reply again, checking the address and payload survive the
+// round trip unchanged.
+func TestUDPHeaderIPv6RoundTrip(t *testing.T) {
+	const wantHost = "2001:db8::1"
+	const wantPort = 5353
+
+	ip := net.ParseIP(wantHost).To16()
+	if ip == nil {
+		t.Fatalf("test setup: %q did not parse as an IP", wantHost)
+	}
+
+	hdr := make([]byte, 3+1+net.IPv6len+2)
+	hdr[0] = socksVersion5
+	hdr[1] = 0 // standalone datagram, no fragmentation
+	hdr[3] = socksAddrIPv6
+	copy(hdr[4:4+net.IPv6len], ip)
+	binary.BigEndian.PutUint16(hdr[4+net.IPv6len:], wantPort)
+
+	payload := []byte("hello ipv6")
+	in := append(append([]byte{}, hdr...), payload...)
+
+	frag, dst, err := parseUDPHeader(nil, in, true)
+	if err != nil {
+		t.Fatalf("parseUDPHeader: %v", err)
+	}
+	if frag != 0 {
+		t.Fatalf("expected standalone FRAG, got %#x", frag)
+	}
+	if !dst.ip.Equal(net.ParseIP(wantHost)) || dst.port != wantPort {
+		t.Fatalf("parsed addr mismatch: ip=%v port=%d", dst.ip, dst.port)
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP relay: %v", err)
+	}
+	defer relay.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP client: %v", err)
+	}
+	defer client.Close()
+
+	bridge := &udpBridgeConn{
+		UDPConn: relay,
+		socks:   true,
+		udpSrc:  client.LocalAddr(),
+		dst:     dst,
+	}
+
+	if _, err := bridge.write(payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	rbuf := make([]byte, 2048)
+	n, _, err := client.ReadFrom(rbuf)
+	if err != nil {
+		t.Fatalf("client ReadFrom: %v", err)
+	}
+
+	_, back, err := parseUDPHeader(nil, rbuf[:n], true)
+	if err != nil {
+		t.Fatalf("parseUDPHeader on reply: %v", err)
+	}
+	if !back.ip.Equal(net.ParseIP(wantHost)) || back.port != wantPort {
+		t.Fatalf("round-tripped addr mismatch: ip=%v port=%d", back.ip, back.port)
+	}
+	if got := rbuf[back.size:n]; !bytes.Equal(got, payload) {
+		t.Fatalf("round-tripped payload mismatch: got %q, want %q", got, payload)
+	}
+}